@@ -0,0 +1,60 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package db
+
+// generateSQLPatches lists incremental schema changes applied, in order, on top of the base
+// schema. Only the CREATE TABLE statement is idempotent on its own (IF NOT EXISTS); the
+// ALTER TABLE ... ADD COLUMN statements fail when their column already exists, and
+// deployOrchestrator tolerates and ignores "duplicate column"/"already exists" errors so the
+// same patch set can be re-applied safely against an already up-to-date schema.
+var generateSQLPatches = []string{
+	`
+		ALTER TABLE database_instance
+			ADD COLUMN region varchar(32) NOT NULL DEFAULT ''
+	`,
+	`
+		ALTER TABLE database_instance
+			ADD COLUMN rpl_semi_sync_master_status tinyint unsigned NOT NULL DEFAULT 0
+	`,
+	`
+		ALTER TABLE database_instance
+			ADD COLUMN rpl_semi_sync_master_clients int unsigned NOT NULL DEFAULT 0
+	`,
+	`
+		ALTER TABLE database_instance
+			ADD COLUMN rpl_semi_sync_slave_status tinyint unsigned NOT NULL DEFAULT 0
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS database_instance_analysis_evidence (
+		  id bigint(20) not null auto_increment,
+		  hostname varchar(128) not null,
+		  port smallint(5) unsigned not null,
+		  analysis_timestamp timestamp not null default current_timestamp,
+		  analysis varchar(128) not null,
+		  observer_hostname varchar(128) not null,
+		  observer_port smallint(5) unsigned not null,
+		  observer_can_see_master tinyint unsigned not null,
+		  observer_last_io_error text not null,
+		  PRIMARY KEY (id),
+		  KEY hostname_port_timestamp_idx (hostname, port, analysis_timestamp)
+		) engine=innodb default charset=utf8
+	`,
+	`
+		ALTER TABLE database_instance_analysis_changelog
+			ADD COLUMN rule_name varchar(128) NOT NULL DEFAULT '' AFTER analysis
+	`,
+}
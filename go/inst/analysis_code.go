@@ -0,0 +1,46 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+// Data-center / region aware analysis codes. These let the classifier tell a real dead
+// master apart from a DC-level network partition, where cross-DC replicas keep replicating
+// even though same-DC observers have lost sight of the master.
+const (
+	// DeadMasterDCIsolated indicates same-DC observers cannot reach the master, but replicas
+	// in other data centers still replicate from it -- this is symptomatic of a DC/region
+	// network partition rather than a dead master.
+	DeadMasterDCIsolated AnalysisCode = "DeadMasterDCIsolated"
+	// UnreachableMasterWithLaggingReplicas indicates the master is unreachable and its
+	// remaining replicating slaves are all lagging, strengthening the suspicion that the
+	// master is genuinely stuck rather than behind a transient network blip.
+	UnreachableMasterWithLaggingReplicas AnalysisCode = "UnreachableMasterWithLaggingReplicas"
+)
+
+// Semi-sync aware analysis codes. These let the classifier reason about lossless semi-sync
+// deployments, where naively promoting the most up-to-date replica is not always safe.
+const (
+	// MasterSemiSyncMustBlock indicates a semi-sync master has no acknowledging semi-sync
+	// slaves, so writes are stalling while waiting for an ack that will never come.
+	MasterSemiSyncMustBlock AnalysisCode = "MasterSemiSyncMustBlock"
+	// LosslessSemiSyncMasterDead indicates a dead semi-sync master where at least one slave
+	// holds the highest GTID and has confirmed receipt of the last transactions, making it a
+	// safe promotion target.
+	LosslessSemiSyncMasterDead AnalysisCode = "LosslessSemiSyncMasterDead"
+	// DeadMasterUnsafeToPromote indicates a dead master where no slave has confirmed receipt
+	// of the last transactions; promoting any replica now risks data loss.
+	DeadMasterUnsafeToPromote AnalysisCode = "DeadMasterUnsafeToPromote"
+)
@@ -19,6 +19,7 @@ package inst
 import (
 	"fmt"
 	"regexp"
+	"sync"
 
 	"github.com/outbrain/golib/log"
 	"github.com/outbrain/golib/sqlutils"
@@ -59,6 +60,11 @@ func GetReplicationAnalysis(includeDowntimed bool) ([]ReplicationAnalysis, error
 		        MIN(master_instance.master_host IN ('' , '_')
 		            OR master_instance.master_port = 0) AS is_master,
 		        MIN(master_instance.is_co_master) AS is_co_master,
+		        MIN(master_instance.data_center) AS data_center,
+		        MIN(master_instance.region) AS region,
+		        MIN(master_instance.physical_environment) AS physical_environment,
+		        MIN(master_instance.rpl_semi_sync_master_status) AS is_semi_sync_master,
+		        MIN(master_instance.rpl_semi_sync_master_clients) AS semi_sync_master_clients,
 		        MIN(CONCAT(master_instance.hostname,
 		                ':',
 		                master_instance.port) = master_instance.cluster_name) AS is_cluster_master,
@@ -75,6 +81,36 @@ func GetReplicationAnalysis(includeDowntimed bool) ([]ReplicationAnalysis, error
 		                    AND slave_instance.slave_sql_running = 1),
 		                0) AS count_slaves_failing_to_connect_to_master,
 		        MIN(master_instance.replication_depth) AS replication_depth,
+		        IFNULL(SUM(slave_instance.data_center = master_instance.data_center),
+		                0) AS count_slaves_in_same_dc,
+		        IFNULL(SUM(slave_instance.data_center = master_instance.data_center
+		                    AND slave_instance.last_checked <= slave_instance.last_seen
+		                    AND slave_instance.slave_io_running != 0
+		                    AND slave_instance.slave_sql_running != 0),
+		                0) AS count_valid_replicating_slaves_in_same_dc,
+		        IFNULL(SUM(slave_instance.data_center != master_instance.data_center
+		                    AND slave_instance.last_checked <= slave_instance.last_seen
+		                    AND slave_instance.slave_io_running != 0
+		                    AND slave_instance.slave_sql_running != 0),
+		                0) AS count_replicas_in_different_dc,
+		        IFNULL(SUM(slave_instance.last_checked <= slave_instance.last_seen
+		                    AND slave_instance.slave_io_running != 0
+		                    AND slave_instance.slave_sql_running != 0
+		                    AND slave_instance.slave_lag_seconds > %d),
+		                0) AS count_stuck_lagging_slaves,
+		        IFNULL(MAX(slave_instance.slave_lag_seconds), 0) AS replication_lag_seconds,
+		        IFNULL(SUM(slave_instance.rpl_semi_sync_slave_status
+		                    AND slave_instance.last_checked <= slave_instance.last_seen
+		                    AND slave_instance.slave_io_running != 0),
+		                0) AS count_semi_sync_replicating_slaves,
+		        SUBSTRING_INDEX(GROUP_CONCAT(
+		                CASE WHEN
+		                        master_instance.executed_gtid_set != ''
+		                        AND GTID_SUBSET(master_instance.executed_gtid_set, slave_instance.executed_gtid_set)
+		                    THEN CONCAT(slave_instance.hostname, ':', slave_instance.port)
+		                END
+		                ORDER BY LENGTH(slave_instance.executed_gtid_set) DESC
+		                SEPARATOR ','), ',', 1) AS confirmed_caught_up_slave_hostport,
 		        GROUP_CONCAT(slave_instance.Hostname, ':', slave_instance.Port) as slave_hosts,
 		        MIN(
 		            master_instance.slave_sql_running = 1
@@ -137,13 +173,19 @@ func GetReplicationAnalysis(includeDowntimed bool) ([]ReplicationAnalysis, error
 			    is_master DESC ,
 			    is_cluster_master DESC,
 			    count_slaves DESC
-	`, config.Config.InstancePollSeconds, analysisQueryReductionClause)
+	`, config.Config.InstancePollSeconds, config.Config.UnreachableMasterStuckReplicationLagSeconds, analysisQueryReductionClause)
 
+	analyses := []ReplicationAnalysis{}
 	err := db.QueryOrchestratorRowsMap(query, func(m sqlutils.RowMap) error {
 		a := ReplicationAnalysis{Analysis: NoProblem}
 
 		a.IsMaster = m.GetBool("is_master")
 		a.IsCoMaster = m.GetBool("is_co_master")
+		a.DataCenter = m.GetString("data_center")
+		a.Region = m.GetString("region")
+		a.PhysicalEnvironment = m.GetString("physical_environment")
+		a.IsSemiSyncMaster = m.GetBool("is_semi_sync_master")
+		a.SemiSyncMasterClients = m.GetUint("semi_sync_master_clients")
 		a.AnalyzedInstanceKey = InstanceKey{Hostname: m.GetString("hostname"), Port: m.GetInt("port")}
 		a.AnalyzedInstanceMasterKey = InstanceKey{Hostname: m.GetString("master_host"), Port: m.GetInt("master_port")}
 		a.ClusterDetails.ClusterName = m.GetString("cluster_name")
@@ -153,6 +195,18 @@ func GetReplicationAnalysis(includeDowntimed bool) ([]ReplicationAnalysis, error
 		a.CountValidSlaves = m.GetUint("count_valid_slaves")
 		a.CountValidReplicatingSlaves = m.GetUint("count_valid_replicating_slaves")
 		a.CountSlavesFailingToConnectToMaster = m.GetUint("count_slaves_failing_to_connect_to_master")
+		a.CountSlavesInSameDC = m.GetUint("count_slaves_in_same_dc")
+		a.CountValidReplicatingSlavesInSameDC = m.GetUint("count_valid_replicating_slaves_in_same_dc")
+		a.CountReplicasInDifferentDC = m.GetUint("count_replicas_in_different_dc")
+		a.CountStuckLaggingSlaves = m.GetUint("count_stuck_lagging_slaves")
+		a.ReplicationLagSeconds = m.GetUint("replication_lag_seconds")
+		a.CountSemiSyncReplicatingSlaves = m.GetUint("count_semi_sync_replicating_slaves")
+		if hostPort := m.GetString("confirmed_caught_up_slave_hostport"); hostPort != "" {
+			if promotionHint, err := ParseInstanceKey(hostPort); err == nil {
+				a.PromotionHint = *promotionHint
+				a.PromotionHintConfirmed = true
+			}
+		}
 		a.ReplicationDepth = m.GetUint("replication_depth")
 		a.IsFailingToConnectToMaster = m.GetBool("is_failing_to_connect_to_master")
 		a.IsDowntimed = m.GetBool("is_downtimed")
@@ -171,105 +225,33 @@ func GetReplicationAnalysis(includeDowntimed bool) ([]ReplicationAnalysis, error
 		countBinlogServerSlaves := m.GetUint("count_binlog_server_slaves")
 		a.BinlogServerImmediateTopology = countBinlogServerSlaves == a.CountValidSlaves && a.CountValidSlaves > 0
 
-		if a.IsMaster && !a.LastCheckValid && a.CountSlaves == 0 {
-			a.Analysis = DeadMasterWithoutSlaves
-			a.Description = "Master cannot be reached by orchestrator and has no slave"
-			//
-		} else if a.IsMaster && !a.LastCheckValid && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadMaster
-			a.Description = "Master cannot be reached by orchestrator and none of its slaves is replicating"
-			//
-		} else if a.IsMaster && !a.LastCheckValid && a.CountSlaves > 0 && a.CountValidSlaves == 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadMasterAndSlaves
-			a.Description = "Master cannot be reached by orchestrator and none of its slaves is replicating"
-			//
-		} else if a.IsMaster && !a.LastCheckValid && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadMasterAndSomeSlaves
-			a.Description = "Master cannot be reached by orchestrator; some of its slaves are unreachable and none of its reachable slaves is replicating"
-			//
-		} else if a.IsMaster && !a.LastCheckValid && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves > 0 {
-			a.Analysis = UnreachableMaster
-			a.Description = "Master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue"
-			//
-		} else if a.IsMaster && a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = MasterSingleSlaveNotReplicating
-			a.Description = "Master is reachable but its single slave is not replicating"
-			//
-		} else if a.IsMaster && a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == 0 {
-			a.Analysis = MasterSingleSlaveDead
-			a.Description = "Master is reachable but its single slave is dead"
-			//
-		} else if a.IsMaster && a.LastCheckValid && a.CountSlaves > 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = AllMasterSlavesNotReplicating
-			a.Description = "Master is reachable but none of its slaves is replicating"
-			//
-		} else if a.IsMaster && a.LastCheckValid && a.CountSlaves > 1 && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = AllMasterSlavesNotReplicatingOrDead
-			a.Description = "Master is reachable but none of its slaves is replicating"
-			//
-		} else /* co-master */ if a.IsCoMaster && !a.LastCheckValid && a.CountSlaves > 0 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadCoMaster
-			a.Description = "Co-master cannot be reached by orchestrator and none of its slaves is replicating"
-			//
-		} else if a.IsCoMaster && !a.LastCheckValid && a.CountSlaves > 0 && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadCoMasterAndSomeSlaves
-			a.Description = "Co-master cannot be reached by orchestrator; some of its slaves are unreachable and none of its reachable slaves is replicating"
-			//
-		} else if a.IsCoMaster && !a.LastCheckValid && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves > 0 {
-			a.Analysis = UnreachableCoMaster
-			a.Description = "Co-master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue"
-			//
-		} else if a.IsCoMaster && a.LastCheckValid && a.CountSlaves > 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = AllCoMasterSlavesNotReplicating
-			a.Description = "Co-master is reachable but none of its slaves is replicating"
-			//
-		} else /* intermediate-master */ if !a.IsMaster && !a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == a.CountSlaves && a.CountSlavesFailingToConnectToMaster == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadIntermediateMasterWithSingleSlaveFailingToConnect
-			a.Description = "Intermediate master cannot be reached by orchestrator and its (single) slave is failing to connect"
-			//
-		} else /* intermediate-master */ if !a.IsMaster && !a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadIntermediateMasterWithSingleSlave
-			a.Description = "Intermediate master cannot be reached by orchestrator and its (single) slave is not replicating"
-			//
-		} else /* intermediate-master */ if !a.IsMaster && !a.LastCheckValid && a.CountSlaves > 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadIntermediateMaster
-			a.Description = "Intermediate master cannot be reached by orchestrator and none of its slaves is replicating"
-			//
-		} else if !a.IsMaster && !a.LastCheckValid && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = DeadIntermediateMasterAndSomeSlaves
-			a.Description = "Intermediate master cannot be reached by orchestrator; some of its slaves are unreachable and none of its reachable slaves is replicating"
-			//
-		} else if !a.IsMaster && !a.LastCheckValid && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves > 0 {
-			a.Analysis = UnreachableIntermediateMaster
-			a.Description = "Intermediate master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue"
-			//
-		} else if !a.IsMaster && a.LastCheckValid && a.CountSlaves > 1 && a.CountValidReplicatingSlaves == 0 &&
-			a.CountSlavesFailingToConnectToMaster > 0 && a.CountSlavesFailingToConnectToMaster == a.CountValidSlaves {
-			// All slaves are either failing to connect to master (and at least one of these have to exist)
-			// or completely dead.
-			// Must have at least two slaves to reach such conclusion -- do note that the intermediate master is still
-			// reachable to orchestrator, so we base our conclusion on slaves only at this point.
-			a.Analysis = AllIntermediateMasterSlavesFailingToConnectOrDead
-			a.Description = "Intermediate master is reachable but all of its slaves are failing to connect"
-			//
-		} else if !a.IsMaster && a.LastCheckValid && a.CountSlaves > 0 && a.CountValidReplicatingSlaves == 0 {
-			a.Analysis = AllIntermediateMasterSlavesNotReplicating
-			a.Description = "Intermediate master is reachable but none of its slaves is replicating"
-			//
-		} else if a.IsBinlogServer && a.IsFailingToConnectToMaster {
-			a.Analysis = BinlogServerFailingToConnectToMaster
-			a.Description = "Binlog server is unable to connect to its master"
-			//
-		} else if a.ReplicationDepth == 1 && a.IsFailingToConnectToMaster {
-			a.Analysis = FirstTierSlaveFailingToConnectToMaster
-			a.Description = "1st tier slave (directly replicating from topology master) is unable to connect to the master"
-			//
+		if rule := evaluateAnalysisRules(&a); rule != nil {
+			a.Analysis = rule.Code
+			a.Description = rule.Description
+			a.AnalysisRuleName = rule.Name
+		}
+
+		analyses = append(analyses, a)
+		return nil
+	})
+
+	if err != nil {
+		log.Errore(err)
+		return result, err
+	}
+
+	// Re-probe dead-master candidates for observer confirmation only now that the row cursor
+	// has closed: confirmDeadMasterWithObservers does blocking network I/O, and running it
+	// inside the QueryOrchestratorRowsMap callback would serialize every candidate's re-probe
+	// behind the open result set -- exactly when a correlated outage produces the most
+	// candidates at once.
+	for i := range analyses {
+		if isDeadMasterAnalysis(analyses[i].Analysis) {
+			analyses[i].Analysis = confirmDeadMasterWithObservers(&analyses[i])
 		}
-		//		 else if a.IsMaster && a.CountSlaves == 0 {
-		//			a.Analysis = MasterWithoutSlaves
-		//			a.Description = "Master has no slaves"
-		//		}
+	}
 
+	for _, a := range analyses {
 		if a.Analysis != NoProblem {
 			skipThisHost := false
 			for _, filter := range config.Config.RecoveryIgnoreHostnameFilters {
@@ -285,22 +267,154 @@ func GetReplicationAnalysis(includeDowntimed bool) ([]ReplicationAnalysis, error
 			}
 		}
 		if a.CountSlaves > 0 {
-			// Interesting enough for analysis
-			AuditInstanceAnalysisInChangelog(&a.AnalyzedInstanceKey, a.Analysis)
+			previousAnalysis := recordAndDiffAnalysis(a.AnalyzedInstanceKey, a.Analysis)
+			if previousAnalysis != a.Analysis {
+				// Only interesting the moment the analysis actually changes: publish the
+				// transition to every registered detection event sink (the MySQL changelog
+				// is always one of them). Republishing the same analysis on every poll
+				// cycle would otherwise flood sinks with no new information.
+				publishDetectionEvent(&DetectionEvent{
+					ClusterName:                 a.ClusterDetails.ClusterName,
+					ClusterAlias:                a.ClusterDetails.ClusterAlias,
+					AnalyzedInstanceKey:         a.AnalyzedInstanceKey,
+					DataCenter:                  a.DataCenter,
+					PreviousAnalysis:            previousAnalysis,
+					Analysis:                    a.Analysis,
+					RuleName:                    a.AnalysisRuleName,
+					CountSlaves:                 a.CountSlaves,
+					CountValidReplicatingSlaves: a.CountValidReplicatingSlaves,
+				})
+			}
 		}
-		return nil
-	})
+	}
+
+	return result, nil
+}
+
+// isDeadMasterAnalysis returns true for the family of analysis codes that declare a master
+// (or intermediate/co-master) dead based purely on orchestrator's own, single-vantage-point probe.
+func isDeadMasterAnalysis(analysisCode AnalysisCode) bool {
+	switch analysisCode {
+	case DeadMaster, DeadMasterAndSlaves, DeadIntermediateMaster, DeadCoMaster, LosslessSemiSyncMasterDead, DeadMasterUnsafeToPromote:
+		return true
+	}
+	return false
+}
+
+// observerVote is one slave's eyewitness account of whether it can currently reach the
+// candidate dead master, gathered via an on-demand SHOW SLAVE STATUS re-probe.
+type observerVote struct {
+	ObserverKey  InstanceKey
+	CanSeeMaster bool
+	LastIOError  string
+	Err          error
+}
+
+// confirmDeadMasterWithObservers re-probes a bounded set of the candidate's slaves before
+// orchestrator commits to a Dead* verdict. It protects against a single transient network
+// blip between orchestrator and the master being mistaken for a real failure: the verdict is
+// only kept if at least FailureDetectionMinObserverAgreement out of FailureDetectionObservers
+// polled slaves either report that they, too, cannot see the master, or cannot be probed at all.
+func confirmDeadMasterWithObservers(analysis *ReplicationAnalysis) AnalysisCode {
+	observers := config.Config.FailureDetectionObservers
+	if observers <= 0 {
+		// Feature disabled: preserve existing single-poll-driven behavior.
+		return analysis.Analysis
+	}
+	minAgreement := config.Config.FailureDetectionMinObserverAgreement
+	if minAgreement <= 0 {
+		minAgreement = 1
+	}
+
+	observerKeys := analysis.SlaveHosts.GetInstanceKeys()
+	if len(observerKeys) > observers {
+		observerKeys = observerKeys[:observers]
+	}
+	if len(observerKeys) == 0 {
+		return analysis.Analysis
+	}
+
+	votesChan := make(chan observerVote, len(observerKeys))
+	var wg sync.WaitGroup
+	for _, observerKey := range observerKeys {
+		wg.Add(1)
+		go func(observerKey InstanceKey) {
+			defer wg.Done()
+			votesChan <- probeMasterReachabilityFromSlave(observerKey, analysis.AnalyzedInstanceKey)
+		}(observerKey)
+	}
+	wg.Wait()
+	close(votesChan)
+
+	votes := []observerVote{}
+	agreement := 0
+	for vote := range votesChan {
+		votes = append(votes, vote)
+		if vote.Err != nil || !vote.CanSeeMaster {
+			// An observer we couldn't even reach is not evidence that the master is fine --
+			// it's consistent with the same outage taking down the master, so it counts
+			// toward agreement rather than being silently dropped from the tally.
+			agreement++
+		}
+	}
+	go recordAnalysisEvidence(&analysis.AnalyzedInstanceKey, analysis.Analysis, votes)
+
+	if agreement >= minAgreement {
+		return analysis.Analysis
+	}
+	return UnreachableMaster
+}
 
+// observerCannotConnectToMasterPattern matches a Last_IO_Error indicating the slave I/O thread
+// itself cannot connect or reconnect to the master, mirroring the pattern used to derive
+// is_failing_to_connect_to_master in the main analysis query above.
+var observerCannotConnectToMasterPattern = regexp.MustCompile(`error (connecting|reconnecting) to master`)
+
+// probeMasterReachabilityFromSlave connects to a single slave and inspects its current
+// SHOW SLAVE STATUS to see whether it, independently of orchestrator, can reach the master.
+// The vote is based purely on the I/O thread: the SQL thread can be stopped or lagging for
+// reasons that have nothing to do with master reachability, and would otherwise make a
+// perfectly reachable master look dead.
+func probeMasterReachabilityFromSlave(observerKey InstanceKey, masterKey InstanceKey) observerVote {
+	vote := observerVote{ObserverKey: observerKey}
+	slave, err := ReadTopologyInstance(&observerKey)
 	if err != nil {
-		log.Errore(err)
+		vote.Err = err
+		return vote
+	}
+	vote.LastIOError = slave.LastIOError
+	vote.CanSeeMaster = slave.SlaveIORunning && !observerCannotConnectToMasterPattern.MatchString(slave.LastIOError)
+	return vote
+}
+
+// recordAnalysisEvidence persists the observer votes gathered while re-probing a Dead* candidate,
+// whether the verdict was then kept or downgraded, so it can be shown *why* orchestrator did or
+// did not conclude a master was dead. The changelog does not read this table.
+func recordAnalysisEvidence(instanceKey *InstanceKey, analysisCode AnalysisCode, votes []observerVote) {
+	for _, vote := range votes {
+		_, err := db.ExecOrchestrator(`
+				insert into database_instance_analysis_evidence (
+						hostname, port, analysis_timestamp, analysis,
+						observer_hostname, observer_port, observer_can_see_master, observer_last_io_error
+					) values (
+						?, ?, now(), ?, ?, ?, ?, ?
+					)
+				`,
+			instanceKey.Hostname, instanceKey.Port, string(analysisCode),
+			vote.ObserverKey.Hostname, vote.ObserverKey.Port, vote.CanSeeMaster, vote.LastIOError,
+		)
+		if err != nil {
+			log.Errore(err)
+		}
 	}
-	return result, err
 }
 
 // AuditInstanceAnalysisInChangelog will write down an instance's analysis in the database_instance_analysis_changelog table.
 // To not repeat recurring analysis code, the database_instance_last_analysis table is used, so that only changes to
-// analysis codes are written.
-func AuditInstanceAnalysisInChangelog(instanceKey *InstanceKey, analysisCode AnalysisCode) error {
+// analysis codes are written. ruleName records which AnalysisRule (built-in or user-defined) fired,
+// so operators can trace *why* orchestrator reached this verdict. When observer confirmation downgrades
+// a Dead* verdict to UnreachableMaster, ruleName still names the Dead* rule that fired.
+func AuditInstanceAnalysisInChangelog(instanceKey *InstanceKey, analysisCode AnalysisCode, ruleName string) error {
 	sqlResult, err := db.ExecOrchestrator(`
 			insert ignore into database_instance_last_analysis (
 					hostname, port, analysis_timestamp, analysis
@@ -327,12 +441,12 @@ func AuditInstanceAnalysisInChangelog(instanceKey *InstanceKey, analysisCode Ana
 
 	_, err = db.ExecOrchestrator(`
 			insert into database_instance_analysis_changelog (
-					hostname, port, analysis_timestamp, analysis
+					hostname, port, analysis_timestamp, analysis, rule_name
 				) values (
-					?, ?, now(), ?
+					?, ?, now(), ?, ?
 				) 					
 			`,
-		instanceKey.Hostname, instanceKey.Port, string(analysisCode),
+		instanceKey.Hostname, instanceKey.Port, string(analysisCode), ruleName,
 	)
 	return log.Errore(err)
 }
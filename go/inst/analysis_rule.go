@@ -0,0 +1,416 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/go/config"
+)
+
+// AnalysisRule is one entry in the classifier: when Predicate matches a ReplicationAnalysis,
+// Code (and Description) are applied to it. Rules are evaluated in descending Priority order;
+// the first match wins, mirroring the mutually-exclusive if/else cascade this replaces.
+type AnalysisRule struct {
+	Name        string
+	Predicate   func(*ReplicationAnalysis) bool
+	Code        AnalysisCode
+	Description string
+	Priority    int
+}
+
+var (
+	analysisRulesMutex      sync.Mutex
+	analysisRules           []*AnalysisRule
+	analysisRulesLoadedOnce sync.Once
+)
+
+// RegisterAnalysisRule adds a rule to the registry, keeping the registry sorted by descending
+// priority. Built-in rules register themselves from this file's init(); user rules are loaded
+// on first use from config.Config.AnalysisRulesFile.
+func RegisterAnalysisRule(rule *AnalysisRule) {
+	analysisRulesMutex.Lock()
+	defer analysisRulesMutex.Unlock()
+	analysisRules = append(analysisRules, rule)
+	sort.SliceStable(analysisRules, func(i, j int) bool {
+		return analysisRules[i].Priority > analysisRules[j].Priority
+	})
+}
+
+// evaluateAnalysisRules returns the highest-priority rule whose predicate matches, or nil if
+// none match (the analysis remains NoProblem).
+func evaluateAnalysisRules(analysis *ReplicationAnalysis) *AnalysisRule {
+	ensureUserAnalysisRulesLoaded()
+
+	analysisRulesMutex.Lock()
+	rules := make([]*AnalysisRule, len(analysisRules))
+	copy(rules, analysisRules)
+	analysisRulesMutex.Unlock()
+
+	for _, rule := range rules {
+		if rule.Predicate(analysis) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ensureUserAnalysisRulesLoaded loads config.Config.AnalysisRulesFile exactly once per process,
+// no matter how many goroutines call it concurrently.
+func ensureUserAnalysisRulesLoaded() {
+	analysisRulesLoadedOnce.Do(func() {
+		if config.Config.AnalysisRulesFile != "" {
+			if err := LoadAnalysisRulesFile(config.Config.AnalysisRulesFile); err != nil {
+				log.Errore(err)
+			}
+		}
+	})
+}
+
+// LoadAnalysisRulesFile parses a user-supplied rules file and registers each rule it finds.
+// User rules default to a lower priority than any built-in rule, so they only apply to
+// situations none of the built-ins already recognize -- unless the rule body overrides that
+// via an explicit "priority:<n>" clause after the analysis code.
+func LoadAnalysisRulesFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return log.Errorf("cannot read AnalysisRulesFile %s: %+v", path, err)
+	}
+	for lineNumber, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseAnalysisRuleLine(line)
+		if err != nil {
+			return log.Errorf("%s line %d: %+v", path, lineNumber+1, err)
+		}
+		RegisterAnalysisRule(rule)
+	}
+	return nil
+}
+
+// parseAnalysisRuleLine parses a single DSL line of the form:
+//   <bool expression> => "<AnalysisCode>" [priority:<n>]
+// e.g.
+//   is_master && count_valid_replicating_slaves == 0 && count_slaves > 5 => "LaggedMasterFleet"
+func parseAnalysisRuleLine(line string) (*AnalysisRule, error) {
+	parts := strings.SplitN(line, "=>", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected '<condition> => \"<AnalysisCode>\"', got: %s", line)
+	}
+	predicateSource := strings.TrimSpace(parts[0])
+	rest := strings.TrimSpace(parts[1])
+
+	priority := userAnalysisRulePriority
+	if idx := strings.Index(rest, "priority:"); idx >= 0 {
+		fmt.Sscanf(rest[idx+len("priority:"):], "%d", &priority)
+		rest = strings.TrimSpace(rest[:idx])
+	}
+
+	code := strings.Trim(rest, `"`)
+	if code == "" {
+		return nil, fmt.Errorf("missing analysis code after '=>' in: %s", line)
+	}
+
+	expr, err := parseBoolExpression(predicateSource)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %+v", predicateSource, err)
+	}
+
+	return &AnalysisRule{
+		Name:        fmt.Sprintf("user-rule:%s", code),
+		Predicate:   func(a *ReplicationAnalysis) bool { return expr(a) },
+		Code:        AnalysisCode(code),
+		Description: fmt.Sprintf("matched user-defined rule: %s", predicateSource),
+		Priority:    priority,
+	}, nil
+}
+
+// userAnalysisRulePriority is the default priority given to rules loaded from
+// AnalysisRulesFile -- below every built-in rule, so site-specific rules only fire for
+// situations the built-in classifier does not already have an opinion on.
+const userAnalysisRulePriority = 0
+
+func init() {
+	registerBuiltinAnalysisRules()
+}
+
+// registerBuiltinAnalysisRules re-expresses the classifier's original if/else cascade as an
+// ordered set of rules, highest-priority (i.e. most specific / first-checked) first. Priorities
+// descend in steps of 10 so site-specific rules (priority 0, see userAnalysisRulePriority) can
+// be inserted between built-ins via an explicit "priority:<n>" clause if ever needed.
+func registerBuiltinAnalysisRules() {
+	priority := 10000
+	next := func() int {
+		priority -= 10
+		return priority
+	}
+
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadMasterWithoutSlaves",
+		Code:        DeadMasterWithoutSlaves,
+		Description: "Master cannot be reached by orchestrator and has no slave",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadMasterDCIsolated",
+		Code:        DeadMasterDCIsolated,
+		Description: "Master cannot be reached by any same-DC observer, yet replicas in other data centers are still replicating from it; this looks like a DC/region network partition rather than a dead master",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountSlavesInSameDC > 0 && a.CountValidReplicatingSlavesInSameDC == 0 && a.CountReplicasInDifferentDC > 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "LosslessSemiSyncMasterDead",
+		Code:        LosslessSemiSyncMasterDead,
+		Description: "Semi-sync master cannot be reached by orchestrator; a slave holding the highest GTID has confirmed receipt of the last transactions and is safe to promote",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 && a.IsSemiSyncMaster && a.PromotionHintConfirmed
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadMasterUnsafeToPromote",
+		Code:        DeadMasterUnsafeToPromote,
+		Description: "Semi-sync master cannot be reached by orchestrator and no slave has confirmed receipt of its last transactions; promoting now risks data loss",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0 && a.IsSemiSyncMaster
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadMaster",
+		Code:        DeadMaster,
+		Description: "Master cannot be reached by orchestrator and none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadMasterAndSlaves",
+		Code:        DeadMasterAndSlaves,
+		Description: "Master cannot be reached by orchestrator and none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountSlaves > 0 && a.CountValidSlaves == 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadMasterAndSomeSlaves",
+		Code:        DeadMasterAndSomeSlaves,
+		Description: "Master cannot be reached by orchestrator; some of its slaves are unreachable and none of its reachable slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "UnreachableMasterWithLaggingReplicas",
+		Code:        UnreachableMasterWithLaggingReplicas,
+		Description: "Master cannot be reached by orchestrator and all of its still-replicating slaves are lagging; likely a genuinely stuck master rather than a brief network blip",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountValidReplicatingSlaves > 0 && a.CountStuckLaggingSlaves == a.CountValidReplicatingSlaves
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "UnreachableMaster",
+		Code:        UnreachableMaster,
+		Description: "Master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && !a.LastCheckValid && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves > 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "MasterSingleSlaveNotReplicating",
+		Code:        MasterSingleSlaveNotReplicating,
+		Description: "Master is reachable but its single slave is not replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "MasterSingleSlaveDead",
+		Code:        MasterSingleSlaveDead,
+		Description: "Master is reachable but its single slave is dead",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "AllMasterSlavesNotReplicating",
+		Code:        AllMasterSlavesNotReplicating,
+		Description: "Master is reachable but none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && a.LastCheckValid && a.CountSlaves > 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "AllMasterSlavesNotReplicatingOrDead",
+		Code:        AllMasterSlavesNotReplicatingOrDead,
+		Description: "Master is reachable but none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && a.LastCheckValid && a.CountSlaves > 1 && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadCoMaster",
+		Code:        DeadCoMaster,
+		Description: "Co-master cannot be reached by orchestrator and none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsCoMaster && !a.LastCheckValid && a.CountSlaves > 0 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadCoMasterAndSomeSlaves",
+		Code:        DeadCoMasterAndSomeSlaves,
+		Description: "Co-master cannot be reached by orchestrator; some of its slaves are unreachable and none of its reachable slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsCoMaster && !a.LastCheckValid && a.CountSlaves > 0 && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "UnreachableCoMaster",
+		Code:        UnreachableCoMaster,
+		Description: "Co-master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsCoMaster && !a.LastCheckValid && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves > 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "AllCoMasterSlavesNotReplicating",
+		Code:        AllCoMasterSlavesNotReplicating,
+		Description: "Co-master is reachable but none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsCoMaster && a.LastCheckValid && a.CountSlaves > 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadIntermediateMasterWithSingleSlaveFailingToConnect",
+		Code:        DeadIntermediateMasterWithSingleSlaveFailingToConnect,
+		Description: "Intermediate master cannot be reached by orchestrator and its (single) slave is failing to connect",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return !a.IsMaster && !a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == a.CountSlaves && a.CountSlavesFailingToConnectToMaster == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadIntermediateMasterWithSingleSlave",
+		Code:        DeadIntermediateMasterWithSingleSlave,
+		Description: "Intermediate master cannot be reached by orchestrator and its (single) slave is not replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return !a.IsMaster && !a.LastCheckValid && a.CountSlaves == 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadIntermediateMaster",
+		Code:        DeadIntermediateMaster,
+		Description: "Intermediate master cannot be reached by orchestrator and none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return !a.IsMaster && !a.LastCheckValid && a.CountSlaves > 1 && a.CountValidSlaves == a.CountSlaves && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "DeadIntermediateMasterAndSomeSlaves",
+		Code:        DeadIntermediateMasterAndSomeSlaves,
+		Description: "Intermediate master cannot be reached by orchestrator; some of its slaves are unreachable and none of its reachable slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return !a.IsMaster && !a.LastCheckValid && a.CountValidSlaves < a.CountSlaves && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "UnreachableIntermediateMaster",
+		Code:        UnreachableIntermediateMaster,
+		Description: "Intermediate master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return !a.IsMaster && !a.LastCheckValid && a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves > 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "AllIntermediateMasterSlavesFailingToConnectOrDead",
+		Code:        AllIntermediateMasterSlavesFailingToConnectOrDead,
+		Description: "Intermediate master is reachable but all of its slaves are failing to connect",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			// All slaves are either failing to connect to master (and at least one of these have to exist)
+			// or completely dead. Must have at least two slaves to reach such a conclusion -- the
+			// intermediate master is still reachable to orchestrator, so the conclusion is slave-only.
+			return !a.IsMaster && a.LastCheckValid && a.CountSlaves > 1 && a.CountValidReplicatingSlaves == 0 &&
+				a.CountSlavesFailingToConnectToMaster > 0 && a.CountSlavesFailingToConnectToMaster == a.CountValidSlaves
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "AllIntermediateMasterSlavesNotReplicating",
+		Code:        AllIntermediateMasterSlavesNotReplicating,
+		Description: "Intermediate master is reachable but none of its slaves is replicating",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return !a.IsMaster && a.LastCheckValid && a.CountSlaves > 0 && a.CountValidReplicatingSlaves == 0
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "BinlogServerFailingToConnectToMaster",
+		Code:        BinlogServerFailingToConnectToMaster,
+		Description: "Binlog server is unable to connect to its master",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsBinlogServer && a.IsFailingToConnectToMaster
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "FirstTierSlaveFailingToConnectToMaster",
+		Code:        FirstTierSlaveFailingToConnectToMaster,
+		Description: "1st tier slave (directly replicating from topology master) is unable to connect to the master",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.ReplicationDepth == 1 && a.IsFailingToConnectToMaster
+		},
+	})
+	RegisterAnalysisRule(&AnalysisRule{
+		Name:        "MasterSemiSyncMustBlock",
+		Code:        MasterSemiSyncMustBlock,
+		Description: "Semi-sync master has no acknowledging semi-sync slaves; writes are stalling waiting for an ack",
+		Priority:    next(),
+		Predicate: func(a *ReplicationAnalysis) bool {
+			return a.IsMaster && a.LastCheckValid && a.IsSemiSyncMaster && a.SemiSyncMasterClients == 0 && a.CountSemiSyncReplicatingSlaves == 0 && a.CountSlaves > 0
+		},
+	})
+}
@@ -0,0 +1,225 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// analysisRuleFields maps the DSL field names available to AnalysisRulesFile to the
+// ReplicationAnalysis values they read. Booleans are surfaced as 1/0 so they compose with the
+// same comparison operators as the numeric fields.
+var analysisRuleFields = map[string]func(*ReplicationAnalysis) float64{
+	"is_master":                           boolField(func(a *ReplicationAnalysis) bool { return a.IsMaster }),
+	"is_co_master":                        boolField(func(a *ReplicationAnalysis) bool { return a.IsCoMaster }),
+	"is_last_check_valid":                 boolField(func(a *ReplicationAnalysis) bool { return a.LastCheckValid }),
+	"is_failing_to_connect_to_master":     boolField(func(a *ReplicationAnalysis) bool { return a.IsFailingToConnectToMaster }),
+	"is_binlog_server":                    boolField(func(a *ReplicationAnalysis) bool { return a.IsBinlogServer }),
+	"is_downtimed":                        boolField(func(a *ReplicationAnalysis) bool { return a.IsDowntimed }),
+	"is_semi_sync_master":                 boolField(func(a *ReplicationAnalysis) bool { return a.IsSemiSyncMaster }),
+	"count_slaves":                        uintField(func(a *ReplicationAnalysis) uint { return a.CountSlaves }),
+	"count_valid_slaves":                  uintField(func(a *ReplicationAnalysis) uint { return a.CountValidSlaves }),
+	"count_valid_replicating_slaves":      uintField(func(a *ReplicationAnalysis) uint { return a.CountValidReplicatingSlaves }),
+	"count_slaves_failing_to_connect_to_master": uintField(func(a *ReplicationAnalysis) uint { return a.CountSlavesFailingToConnectToMaster }),
+	"replication_depth":                         uintField(func(a *ReplicationAnalysis) uint { return a.ReplicationDepth }),
+	"count_slaves_in_same_dc":                   uintField(func(a *ReplicationAnalysis) uint { return a.CountSlavesInSameDC }),
+	"count_valid_replicating_slaves_in_same_dc": uintField(func(a *ReplicationAnalysis) uint { return a.CountValidReplicatingSlavesInSameDC }),
+	"count_replicas_in_different_dc":            uintField(func(a *ReplicationAnalysis) uint { return a.CountReplicasInDifferentDC }),
+	"count_stuck_lagging_slaves":                uintField(func(a *ReplicationAnalysis) uint { return a.CountStuckLaggingSlaves }),
+	"replication_lag_seconds":                   uintField(func(a *ReplicationAnalysis) uint { return a.ReplicationLagSeconds }),
+	"count_semi_sync_replicating_slaves":        uintField(func(a *ReplicationAnalysis) uint { return a.CountSemiSyncReplicatingSlaves }),
+	"semi_sync_master_clients":                  uintField(func(a *ReplicationAnalysis) uint { return a.SemiSyncMasterClients }),
+}
+
+func boolField(get func(*ReplicationAnalysis) bool) func(*ReplicationAnalysis) float64 {
+	return func(a *ReplicationAnalysis) float64 {
+		if get(a) {
+			return 1
+		}
+		return 0
+	}
+}
+
+func uintField(get func(*ReplicationAnalysis) uint) func(*ReplicationAnalysis) float64 {
+	return func(a *ReplicationAnalysis) float64 {
+		return float64(get(a))
+	}
+}
+
+var ruleTokenPattern = regexp.MustCompile(`\s*(&&|\|\||==|!=|>=|<=|[()!<>]|[A-Za-z0-9_.]+)`)
+
+// parseBoolExpression compiles a small boolean DSL over the fields in analysisRuleFields into a
+// predicate. Grammar (highest to lowest precedence): identifier/number, comparison
+// (==, !=, <, <=, >, >=), unary "!", "&&", "||", with "(" ")" for grouping.
+func parseBoolExpression(source string) (func(*ReplicationAnalysis) bool, error) {
+	tokens := ruleTokenPattern.FindAllString(source, -1)
+	for i := range tokens {
+		tokens[i] = regexpTrimSpace(tokens[i])
+	}
+	p := &ruleParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func regexpTrimSpace(s string) string {
+	for len(s) > 0 && (s[0] == ' ' || s[0] == '\t') {
+		s = s[1:]
+	}
+	return s
+}
+
+type ruleParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *ruleParser) parseOr() (func(*ReplicationAnalysis) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		prevLeft := left
+		left = func(a *ReplicationAnalysis) bool { return prevLeft(a) || right(a) }
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (func(*ReplicationAnalysis) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		prevLeft := left
+		left = func(a *ReplicationAnalysis) bool { return prevLeft(a) && right(a) }
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseUnary() (func(*ReplicationAnalysis) bool, error) {
+	if p.peek() == "!" {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(a *ReplicationAnalysis) bool { return !inner(a) }, nil
+	}
+	if p.peek() == "(" {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing ')'")
+		}
+		p.next()
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (func(*ReplicationAnalysis) bool, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch p.peek() {
+	case "==", "!=", ">", ">=", "<", "<=":
+		op := p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return func(a *ReplicationAnalysis) bool {
+			l, r := left(a), right(a)
+			switch op {
+			case "==":
+				return l == r
+			case "!=":
+				return l != r
+			case ">":
+				return l > r
+			case ">=":
+				return l >= r
+			case "<":
+				return l < r
+			case "<=":
+				return l <= r
+			}
+			return false
+		}, nil
+	default:
+		// A bare operand is used as a boolean: non-zero is true.
+		return func(a *ReplicationAnalysis) bool { return left(a) != 0 }, nil
+	}
+}
+
+// parseOperand parses a single identifier (field name) or numeric/boolean literal into a
+// function returning its value as a float64, so it composes uniformly with comparison operators.
+func (p *ruleParser) parseOperand() (func(*ReplicationAnalysis) float64, error) {
+	token := p.next()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	switch token {
+	case "true":
+		return func(*ReplicationAnalysis) float64 { return 1 }, nil
+	case "false":
+		return func(*ReplicationAnalysis) float64 { return 0 }, nil
+	}
+	if field, ok := analysisRuleFields[token]; ok {
+		return field, nil
+	}
+	if value, err := strconv.ParseFloat(token, 64); err == nil {
+		return func(*ReplicationAnalysis) float64 { return value }, nil
+	}
+	return nil, fmt.Errorf("unknown field or literal %q", token)
+}
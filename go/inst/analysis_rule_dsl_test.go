@@ -0,0 +1,128 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import "testing"
+
+func TestParseBoolExpression_ComparisonAndBareBooleanField(t *testing.T) {
+	expr, err := parseBoolExpression("is_master && count_slaves > 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	match := &ReplicationAnalysis{IsMaster: true, CountSlaves: 2}
+	if !expr(match) {
+		t.Fatalf("expected expression to match %+v", match)
+	}
+	noMatch := &ReplicationAnalysis{IsMaster: false, CountSlaves: 2}
+	if expr(noMatch) {
+		t.Fatalf("expected expression not to match %+v", noMatch)
+	}
+}
+
+func TestParseBoolExpression_OrAndNegation(t *testing.T) {
+	expr, err := parseBoolExpression(`!is_last_check_valid || count_valid_slaves == 0`)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !expr(&ReplicationAnalysis{LastCheckValid: false}) {
+		t.Fatal("expected match on !is_last_check_valid")
+	}
+	if !expr(&ReplicationAnalysis{LastCheckValid: true, CountValidSlaves: 0}) {
+		t.Fatal("expected match on count_valid_slaves == 0")
+	}
+	if expr(&ReplicationAnalysis{LastCheckValid: true, CountValidSlaves: 1}) {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestParseBoolExpression_Parentheses(t *testing.T) {
+	expr, err := parseBoolExpression("is_master && (count_slaves == 0 || count_valid_replicating_slaves == 0)")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !expr(&ReplicationAnalysis{IsMaster: true, CountSlaves: 0}) {
+		t.Fatal("expected match via left side of the grouped OR")
+	}
+	if expr(&ReplicationAnalysis{IsMaster: false, CountSlaves: 0}) {
+		t.Fatal("expected no match when is_master is false")
+	}
+}
+
+func TestParseBoolExpression_ReplicationLagSecondsField(t *testing.T) {
+	// replication_lag_seconds compared against a threshold, as a lag-based user rule would use it.
+	expr, err := parseBoolExpression("replication_lag_seconds > 3600")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !expr(&ReplicationAnalysis{ReplicationLagSeconds: 3601}) {
+		t.Fatal("expected match when replication_lag_seconds exceeds the threshold")
+	}
+	if expr(&ReplicationAnalysis{ReplicationLagSeconds: 10}) {
+		t.Fatal("expected no match when replication_lag_seconds is under the threshold")
+	}
+}
+
+func TestParseBoolExpression_UnknownFieldIsAnError(t *testing.T) {
+	if _, err := parseBoolExpression("no_such_field == 1"); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestParseBoolExpression_UnbalancedParenIsAnError(t *testing.T) {
+	if _, err := parseBoolExpression("(is_master && count_slaves > 0"); err == nil {
+		t.Fatal("expected an error for a missing closing paren")
+	}
+}
+
+func TestParseAnalysisRuleLine_ValidLine(t *testing.T) {
+	rule, err := parseAnalysisRuleLine(`is_master && count_valid_replicating_slaves == 0 && count_slaves > 5 => "LaggedMasterFleet"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if rule.Code != "LaggedMasterFleet" {
+		t.Fatalf("expected code LaggedMasterFleet, got %s", rule.Code)
+	}
+	if rule.Priority != userAnalysisRulePriority {
+		t.Fatalf("expected default user priority %d, got %d", userAnalysisRulePriority, rule.Priority)
+	}
+	a := &ReplicationAnalysis{IsMaster: true, CountValidReplicatingSlaves: 0, CountSlaves: 6}
+	if !rule.Predicate(a) {
+		t.Fatalf("expected rule to match %+v", a)
+	}
+}
+
+func TestParseAnalysisRuleLine_ExplicitPriority(t *testing.T) {
+	rule, err := parseAnalysisRuleLine(`is_master => "CustomCode" priority:500`)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if rule.Priority != 500 {
+		t.Fatalf("expected priority 500, got %d", rule.Priority)
+	}
+}
+
+func TestParseAnalysisRuleLine_MissingArrowIsAnError(t *testing.T) {
+	if _, err := parseAnalysisRuleLine(`is_master "DeadMaster"`); err == nil {
+		t.Fatal("expected an error when '=>' is missing")
+	}
+}
+
+func TestParseAnalysisRuleLine_MissingCodeIsAnError(t *testing.T) {
+	if _, err := parseAnalysisRuleLine(`is_master => `); err == nil {
+		t.Fatal("expected an error when the analysis code is empty")
+	}
+}
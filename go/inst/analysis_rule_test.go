@@ -0,0 +1,128 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import "testing"
+
+// These tests exercise the built-in rule registry installed by registerBuiltinAnalysisRules,
+// checking that first-match-wins priority ordering lets the more specific rule win wherever
+// several predicates match the same input.
+
+func TestEvaluateAnalysisRules_DeadMasterWithoutSlavesBeatsDeadMaster(t *testing.T) {
+	// CountSlaves == 0 satisfies both DeadMasterWithoutSlaves and the more general DeadMaster
+	// predicate (0 == 0 on both sides); the more specific rule must win.
+	a := &ReplicationAnalysis{
+		IsMaster:       true,
+		LastCheckValid: false,
+		CountSlaves:    0,
+	}
+	rule := evaluateAnalysisRules(a)
+	if rule == nil {
+		t.Fatal("expected a rule to match, got nil")
+	}
+	if rule.Code != DeadMasterWithoutSlaves {
+		t.Fatalf("expected %s, got %s", DeadMasterWithoutSlaves, rule.Code)
+	}
+}
+
+func TestEvaluateAnalysisRules_DeadMasterDCIsolatedBeatsDeadMaster(t *testing.T) {
+	a := &ReplicationAnalysis{
+		IsMaster:                            true,
+		LastCheckValid:                      false,
+		CountSlaves:                         3,
+		CountValidSlaves:                    3,
+		CountValidReplicatingSlaves:         0,
+		CountSlavesInSameDC:                 2,
+		CountValidReplicatingSlavesInSameDC: 0,
+		CountReplicasInDifferentDC:          1,
+	}
+	rule := evaluateAnalysisRules(a)
+	if rule == nil {
+		t.Fatal("expected a rule to match, got nil")
+	}
+	if rule.Code != DeadMasterDCIsolated {
+		t.Fatalf("expected %s, got %s", DeadMasterDCIsolated, rule.Code)
+	}
+}
+
+func TestEvaluateAnalysisRules_LosslessSemiSyncRequiresConfirmation(t *testing.T) {
+	base := ReplicationAnalysis{
+		IsMaster:                    true,
+		LastCheckValid:              false,
+		CountSlaves:                 2,
+		CountValidSlaves:            2,
+		CountValidReplicatingSlaves: 0,
+		IsSemiSyncMaster:            true,
+	}
+
+	confirmed := base
+	confirmed.PromotionHintConfirmed = true
+	if rule := evaluateAnalysisRules(&confirmed); rule == nil || rule.Code != LosslessSemiSyncMasterDead {
+		t.Fatalf("expected %s when a slave has confirmed receipt, got %+v", LosslessSemiSyncMasterDead, rule)
+	}
+
+	unconfirmed := base
+	unconfirmed.PromotionHintConfirmed = false
+	if rule := evaluateAnalysisRules(&unconfirmed); rule == nil || rule.Code != DeadMasterUnsafeToPromote {
+		t.Fatalf("expected %s when no slave has confirmed receipt, got %+v", DeadMasterUnsafeToPromote, rule)
+	}
+}
+
+func TestEvaluateAnalysisRules_UnreachableMasterWithLaggingReplicas(t *testing.T) {
+	a := &ReplicationAnalysis{
+		IsMaster:                    true,
+		LastCheckValid:              false,
+		CountValidSlaves:            2,
+		CountSlaves:                 2,
+		CountValidReplicatingSlaves: 2,
+		CountStuckLaggingSlaves:     2,
+	}
+	rule := evaluateAnalysisRules(a)
+	if rule == nil || rule.Code != UnreachableMasterWithLaggingReplicas {
+		t.Fatalf("expected %s, got %+v", UnreachableMasterWithLaggingReplicas, rule)
+	}
+}
+
+func TestEvaluateAnalysisRules_NoMatchReturnsNil(t *testing.T) {
+	a := &ReplicationAnalysis{
+		IsMaster:                    true,
+		LastCheckValid:              true,
+		CountSlaves:                 2,
+		CountValidSlaves:            2,
+		CountValidReplicatingSlaves: 2,
+	}
+	if rule := evaluateAnalysisRules(a); rule != nil {
+		t.Fatalf("expected no rule to match a healthy master, got %+v", rule)
+	}
+}
+
+func TestEvaluateAnalysisRules_MasterSemiSyncMustBlock(t *testing.T) {
+	a := &ReplicationAnalysis{
+		IsMaster:                       true,
+		LastCheckValid:                 true,
+		IsSemiSyncMaster:               true,
+		SemiSyncMasterClients:          0,
+		CountSemiSyncReplicatingSlaves: 0,
+		CountSlaves:                    1,
+		CountValidSlaves:               1,
+		CountValidReplicatingSlaves:    1,
+	}
+	rule := evaluateAnalysisRules(a)
+	if rule == nil || rule.Code != MasterSemiSyncMustBlock {
+		t.Fatalf("expected %s, got %+v", MasterSemiSyncMustBlock, rule)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/go/config"
+	"github.com/outbrain/orchestrator/go/db"
+)
+
+// DetectionEvent captures a single replication-analysis state transition, independent of how
+// it is consumed downstream. It carries enough of the classifier's reasoning (the counts that
+// drove the decision, the DC) that a sink does not need to re-query orchestrator to explain it.
+type DetectionEvent struct {
+	ClusterName                 string
+	ClusterAlias                string
+	AnalyzedInstanceKey         InstanceKey
+	DataCenter                  string
+	PreviousAnalysis            AnalysisCode
+	Analysis                    AnalysisCode
+	RuleName                    string
+	CountSlaves                 uint
+	CountValidReplicatingSlaves uint
+}
+
+// DetectionEventSink is anything that wants to be told about replication-analysis state
+// transitions -- including a recovery back to NoProblem -- in addition to, or instead of, the
+// MySQL changelog table.
+type DetectionEventSink interface {
+	// Name identifies the sink for logging purposes.
+	Name() string
+	// Publish is invoked for every analysis transition of an instance that has at least one
+	// slave; transitions of instances without slaves are not published.
+	Publish(event *DetectionEvent) error
+}
+
+var (
+	detectionEventSinksOnce sync.Once
+	detectionEventSinks     []DetectionEventSink
+
+	lastKnownAnalysisSeedOnce   sync.Once
+	lastKnownAnalysisMutex      sync.Mutex
+	lastKnownAnalysisByInstance = make(map[InstanceKey]AnalysisCode)
+)
+
+// seedLastKnownAnalysisFromChangelog loads the persisted per-instance dedup state that the
+// changelog sink already maintains in database_instance_last_analysis, so a process restart
+// does not forget every currently-open issue and re-publish it to the pluggable (webhook/Kafka)
+// sinks on the very next poll.
+func seedLastKnownAnalysisFromChangelog() {
+	lastKnownAnalysisSeedOnce.Do(func() {
+		lastKnownAnalysisMutex.Lock()
+		defer lastKnownAnalysisMutex.Unlock()
+		err := db.QueryOrchestratorRowsMap(`
+				select hostname, port, analysis from database_instance_last_analysis
+			`, func(m sqlutils.RowMap) error {
+			instanceKey := InstanceKey{Hostname: m.GetString("hostname"), Port: m.GetInt("port")}
+			lastKnownAnalysisByInstance[instanceKey] = AnalysisCode(m.GetString("analysis"))
+			return nil
+		})
+		if err != nil {
+			log.Errore(err)
+		}
+	})
+}
+
+// registeredDetectionEventSinks lazily builds the configured sink chain: the MySQL changelog
+// sink is always present, followed by whatever is declared in config.Config.DetectionEventSinks.
+func registeredDetectionEventSinks() []DetectionEventSink {
+	detectionEventSinksOnce.Do(func() {
+		detectionEventSinks = append(detectionEventSinks, NewChangelogDetectionEventSink())
+		for _, sinkConfig := range config.Config.DetectionEventSinks {
+			sink, err := newDetectionEventSink(sinkConfig)
+			if err != nil {
+				log.Errore(err)
+				continue
+			}
+			detectionEventSinks = append(detectionEventSinks, sink)
+		}
+	})
+	return detectionEventSinks
+}
+
+func newDetectionEventSink(sinkConfig config.SinkConfig) (DetectionEventSink, error) {
+	switch sinkConfig.Type {
+	case "webhook":
+		return NewWebhookDetectionEventSink(sinkConfig.URL), nil
+	case "kafka":
+		return NewKafkaDetectionEventSink(sinkConfig.Brokers, sinkConfig.Topic)
+	default:
+		return nil, fmt.Errorf("unsupported detection event sink type: %s", sinkConfig.Type)
+	}
+}
+
+// recordAndDiffAnalysis remembers the most recently observed analysis for an instance and
+// returns what it was before this call, so sinks can report a (previous, new) transition.
+func recordAndDiffAnalysis(instanceKey InstanceKey, analysis AnalysisCode) (previous AnalysisCode) {
+	seedLastKnownAnalysisFromChangelog()
+	lastKnownAnalysisMutex.Lock()
+	defer lastKnownAnalysisMutex.Unlock()
+	previous = lastKnownAnalysisByInstance[instanceKey]
+	lastKnownAnalysisByInstance[instanceKey] = analysis
+	return previous
+}
+
+// publishDetectionEvent fans an analysis transition out to every registered sink, logging (but
+// not failing the analysis pass on) individual sink errors.
+func publishDetectionEvent(event *DetectionEvent) {
+	for _, sink := range registeredDetectionEventSinks() {
+		if err := sink.Publish(event); err != nil {
+			log.Errorf("detection event sink %s failed to publish %+v: %+v", sink.Name(), event, err)
+		}
+	}
+}
+
+// ChangelogDetectionEventSink is the original, always-on sink: it writes transitions into the
+// database_instance_analysis_changelog table via AuditInstanceAnalysisInChangelog.
+type ChangelogDetectionEventSink struct{}
+
+func NewChangelogDetectionEventSink() *ChangelogDetectionEventSink {
+	return &ChangelogDetectionEventSink{}
+}
+
+func (sink *ChangelogDetectionEventSink) Name() string { return "changelog" }
+
+func (sink *ChangelogDetectionEventSink) Publish(event *DetectionEvent) error {
+	return AuditInstanceAnalysisInChangelog(&event.AnalyzedInstanceKey, event.Analysis, event.RuleName)
+}
+
+// WebhookDetectionEventSink POSTs the event as JSON to a configured URL.
+type WebhookDetectionEventSink struct {
+	URL string
+}
+
+func NewWebhookDetectionEventSink(url string) *WebhookDetectionEventSink {
+	return &WebhookDetectionEventSink{URL: url}
+}
+
+func (sink *WebhookDetectionEventSink) Name() string { return "webhook" }
+
+func (sink *WebhookDetectionEventSink) Publish(event *DetectionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(sink.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook sink: unexpected response %s from %s", resp.Status, sink.URL)
+	}
+	return nil
+}
+
+// KafkaDetectionEventSink publishes the event as a JSON message to a Kafka topic.
+type KafkaDetectionEventSink struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func NewKafkaDetectionEventSink(brokers []string, topic string) (*KafkaDetectionEventSink, error) {
+	producer, err := sarama.NewSyncProducer(brokers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaDetectionEventSink{topic: topic, producer: producer}, nil
+}
+
+func (sink *KafkaDetectionEventSink) Name() string { return "kafka" }
+
+func (sink *KafkaDetectionEventSink) Publish(event *DetectionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, _, err = sink.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: sink.topic,
+		Value: sarama.ByteEncoder(body),
+	})
+	return err
+}